@@ -0,0 +1,14 @@
+package agent
+
+// AgentConfiguration holds the settings that control how a worker runs
+// the jobs assigned to it. It's shared by every worker an AgentPool
+// spawns.
+type AgentConfiguration struct {
+	BootstrapScript                string `env:"BUILDKITE_AGENT_BOOTSTRAP_SCRIPT"`
+	BuildPath                      string `env:"BUILDKITE_AGENT_BUILD_PATH"`
+	HooksPath                      string `env:"BUILDKITE_AGENT_HOOKS_PATH"`
+	CommandEval                    bool   `env:"BUILDKITE_AGENT_COMMAND_EVAL"`
+	RunInPty                       bool   `env:"BUILDKITE_AGENT_RUN_IN_PTY"`
+	AutoSSHFingerprintVerification bool   `env:"BUILDKITE_AGENT_AUTO_SSH_FINGERPRINT_VERIFICATION"`
+	ExitWithStatus                 bool   `env:"BUILDKITE_AGENT_EXIT_WITH_STATUS"`
+}
@@ -7,89 +7,329 @@ import (
 	"github.com/buildkite/agent/retry"
 	"github.com/buildkite/agent/signalwatcher"
 	"os"
+	"runtime"
+	"sync"
 	"time"
 )
 
 type AgentPool struct {
-	APIClient          *api.Client
-	Token              string
-	ConfigFilePath     string
-	Name               string
-	Priority           string
-	MetaData           []string
-	MetaDataEC2Tags    bool
-	Endpoint           string
-	AgentConfiguration *AgentConfiguration
+	APIClient           *api.Client
+	Token               string `env:"BUILDKITE_AGENT_TOKEN" required:"true"`
+	ConfigFilePath      string
+	Name                string   `env:"BUILDKITE_AGENT_NAME"`
+	Priority            string   `env:"BUILDKITE_AGENT_PRIORITY"`
+	MetaData            []string `env:"BUILDKITE_AGENT_META_DATA"`
+	MetaDataEC2Tags     bool     `env:"BUILDKITE_AGENT_META_DATA_EC2_TAGS"`
+	MetaDataGCPLabels   bool     `env:"BUILDKITE_AGENT_META_DATA_GCP_LABELS"`
+	MetaDataAzureTags   bool     `env:"BUILDKITE_AGENT_META_DATA_AZURE_TAGS"`
+	MetaDataK8s         bool     `env:"BUILDKITE_AGENT_META_DATA_K8S"`
+	Endpoint            string   `env:"BUILDKITE_AGENT_ENDPOINT"`
+	Spawn               int      `env:"BUILDKITE_AGENT_SPAWN"`
+	SpawnPerCPU         bool     `env:"BUILDKITE_AGENT_SPAWN_PER_CPU"`
+	Extensions          []Extension
+	ExtensionURLs       []string `env:"BUILDKITE_AGENT_EXTENSION_URLS"`
+	ExtensionHMACSecret string   `env:"BUILDKITE_AGENT_EXTENSION_HMAC_SECRET"`
+	AgentConfiguration  *AgentConfiguration
+
+	// FlagsSet records the env var name of every field that was already
+	// set explicitly by a CLI flag (e.g. via flag.Visit), so
+	// BindEnvironmentConfig knows to leave it alone.
+	FlagsSet map[string]bool
+
+	// providerTagsOnce and providerTags cache the result of querying the
+	// enabled cloud/orchestrator meta-data providers, so Spawn/SpawnPerCPU
+	// spawning many workers only pays for those (potentially slow, 5s-
+	// timeout) HTTP calls once per process, not once per worker.
+	providerTagsOnce sync.Once
+	providerTags     []string
 }
 
 func (r *AgentPool) Start() error {
+	// Set anything not already set explicitly by a CLI flag from the
+	// environment (overriding any config file value), then make sure
+	// nothing required is still missing.
+	if err := BindEnvironmentConfig(r, r.FlagsSet); err != nil {
+		logger.Fatal("%s", err)
+	}
+	if err := ValidateRequiredConfig(r); err != nil {
+		logger.Fatal("%s", err)
+	}
+
 	// Show the welcome banner and config options used
 	r.ShowBanner()
 
+	spawn := r.spawnCount()
+	if spawn > 1 {
+		logger.Info("Spawning %d agents", spawn)
+	}
+
 	// Create the agent registration API Client
 	r.APIClient = APIClient{Endpoint: r.Endpoint, Token: r.Token}.Create()
 
+	workers := make([]*AgentWorker, 0, spawn)
+
+	for i := 1; i <= spawn; i++ {
+		name := r.Name
+		if spawn > 1 {
+			name = fmt.Sprintf("%s-%d", r.Name, i)
+		}
+
+		worker, err := r.registerWorker(name)
+		if err != nil {
+			// Don't leave any already-registered workers connected if a
+			// later one in the pool fails - disconnect them first.
+			r.disconnectWorkers(workers)
+			logger.Fatal("%s", err)
+		}
+
+		workers = append(workers, worker)
+	}
+
+	logger.Info("Agent successfully connected")
+	logger.Info("You can press Ctrl-C to stop the agent")
+	logger.Info("Waiting for work...")
+
+	// Now that the agents have connected, we need to start the signal
+	// watcher so in the event of an OS signal, we can forward it on to
+	// each worker's running job, or disconnect the workers entirely. See
+	// dispatchSignal for the full translation table.
+	signalwatcher.Watch(func(sig signalwatcher.Signal) {
+		logger.Debug("Received signal `%s`", sig.String())
+
+		for _, worker := range workers {
+			r.dispatchSignal(worker, sig)
+		}
+	})
+
+	// Starts each agent worker in its own goroutine. This blocks until
+	// every worker has finished or been stopped.
+	exitStatuses := make([]int, len(workers))
+
+	var wg sync.WaitGroup
+	for i, worker := range workers {
+		wg.Add(1)
+
+		go func(i int, worker *AgentWorker) {
+			defer wg.Done()
+
+			if err := worker.Start(); err != nil {
+				logger.Error("%s", err)
+			}
+
+			// Now that the agent has stopped, we can disconnect it
+			logger.Info("Disconnecting %s...", worker.Agent.Name)
+			worker.Disconnect()
+
+			exitStatuses[i] = worker.ExitStatus
+		}(i, worker)
+	}
+	wg.Wait()
+
+	if r.AgentConfiguration.ExitWithStatus {
+		os.Exit(aggregateExitStatus(exitStatuses))
+	}
+
+	return nil
+}
+
+// registerWorker creates an agent template for the given name, registers it
+// with Buildkite, and connects an AgentWorker for it.
+func (r *AgentPool) registerWorker(name string) (*AgentWorker, error) {
 	// Create the agent template. We use pass this template to the register
 	// call, at which point we get back a real agent.
-	template := r.CreateAgentTemplate()
+	template := r.CreateAgentTemplate(name)
 
-	logger.Info("Registering agent with Buildkite...")
+	if err := r.runExtensions(template); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Registering agent \"%s\" with Buildkite...", name)
 
 	// Register the agent
 	registered, err := r.RegisterAgent(template)
 	if err != nil {
-		logger.Fatal("%s", err)
+		return nil, err
 	}
 
 	logger.Info("Successfully registered agent \"%s\" with meta-data %s", registered.Name, registered.MetaData)
 
 	// Now that we have a registereted agent, we can connect it to the API,
 	// and start running jobs.
-	worker := AgentWorker{Agent: registered, AgentConfiguration: r.AgentConfiguration, Endpoint: r.Endpoint}.Create()
+	worker := (&AgentWorker{Agent: registered, AgentConfiguration: r.AgentConfiguration, Endpoint: r.Endpoint}).Create()
 
-	logger.Info("Connecting to Buildkite...")
+	logger.Info("Connecting %s to Buildkite...", name)
 	if err := worker.Connect(); err != nil {
-		logger.Fatal("%s", err)
+		return nil, err
 	}
 
-	logger.Info("Agent successfully connected")
-	logger.Info("You can press Ctrl-C to stop the agent")
-	logger.Info("Waiting for work...")
+	return worker, nil
+}
 
-	// Now that the agent has connected, we need to start the signal
-	// watcher so in the event of a QUIT signal, we can gracefully
-	// disconnect the agent.
-	signalwatcher.Watch(func(sig signalwatcher.Signal) {
-		if sig == signalwatcher.QUIT {
-			logger.Debug("Received signal `%s`", sig.String())
-			worker.Stop()
-		} else {
-			logger.Debug("Ignoring signal `%s`", sig.String())
+// disconnectWorkers cleanly disconnects every worker already registered
+// and connected, so a later registration failure elsewhere in the pool
+// doesn't leak them.
+func (r *AgentPool) disconnectWorkers(workers []*AgentWorker) {
+	for _, worker := range workers {
+		logger.Info("Disconnecting %s...", worker.Agent.Name)
+		worker.Disconnect()
+	}
+}
+
+// spawnCount works out how many agents should be spawned in this process.
+// SpawnPerCPU takes precedence over Spawn, which defaults to a single agent.
+func (r *AgentPool) spawnCount() int {
+	if r.SpawnPerCPU {
+		return runtime.NumCPU()
+	}
+
+	if r.Spawn > 0 {
+		return r.Spawn
+	}
+
+	return 1
+}
+
+// aggregateExitStatus returns the first non-zero exit status amongst the
+// given statuses, or zero if every worker exited cleanly.
+func aggregateExitStatus(statuses []int) int {
+	for _, status := range statuses {
+		if status != 0 {
+			return status
 		}
-	})
+	}
 
-	// Starts the agent worker. This will block until the agent has
-	// finished or is stopped.
-	if err := worker.Start(); err != nil {
-		logger.Fatal("%s", err)
+	return 0
+}
+
+// extensions returns the full, ordered list of registered Extensions: any
+// in-process implementations first, followed by one HTTPExtension per
+// configured --extension-url.
+func (r *AgentPool) extensions() []Extension {
+	extensions := append([]Extension{}, r.Extensions...)
+
+	for _, url := range r.ExtensionURLs {
+		extensions = append(extensions, HTTPExtension{URL: url, HMACSecret: r.ExtensionHMACSecret})
 	}
 
-	// Now that the agent has stopped, we can disconnect it
-	logger.Info("Disconnecting %s...", worker.Agent.Name)
-	worker.Disconnect()
+	return extensions
+}
 
-	if r.AgentConfiguration.ExitWithStatus {
-		os.Exit(worker.ExitStatus)
+// runExtensions calls each registered extension in turn with the agent
+// template, merging any meta-data or priority override it returns back
+// into the template. An extension that errors (including a non-2xx
+// response from an HTTPExtension) aborts registration entirely.
+func (r *AgentPool) runExtensions(template *api.Agent) error {
+	for _, extension := range r.extensions() {
+		result, err := extension.Run(template)
+		if err != nil {
+			return fmt.Errorf("extension refused to register agent: %s", err)
+		}
+
+		if result == nil {
+			continue
+		}
+
+		template.MetaData = append(template.MetaData, result.MetaData...)
+
+		if result.Priority != "" {
+			template.Priority = result.Priority
+		}
 	}
 
 	return nil
 }
 
+// dispatchSignal translates an OS signal received by the pool into an
+// action on a worker, forwarding it to the worker's currently running job
+// where that makes sense. The translation table is:
+//
+//	QUIT          stop: the worker accepts no further work and disconnects
+//	              once any running job has finished; the job is not signalled
+//	INT, TERM     soft drain: cancel the worker's current job (if any),
+//	              then stop accepting further work
+//	HUP,          pass-through: forward the signal to the job's process
+//	USR1, USR2    unchanged, e.g. to trigger a heap dump or log rotation
+//	              inside the job
+//	anything else ignored
+func (r *AgentPool) dispatchSignal(worker *AgentWorker, sig signalwatcher.Signal) {
+	switch sig {
+	case signalwatcher.QUIT:
+		worker.Stop()
+	case signalwatcher.INT, signalwatcher.TERM:
+		worker.CancelCurrentJob()
+		worker.Stop()
+	case signalwatcher.HUP, signalwatcher.USR1, signalwatcher.USR2:
+		worker.ForwardSignal(sig)
+	default:
+		logger.Debug("Ignoring signal `%s`", sig.String())
+	}
+}
+
+// metadataTagProviders returns the MetadataTagProvider implementations
+// enabled via the pool's MetaData* flags, in a stable order.
+func (r *AgentPool) metadataTagProviders() []MetadataTagProvider {
+	providers := []MetadataTagProvider{}
+
+	if r.MetaDataEC2Tags {
+		providers = append(providers, EC2MetaDataTagProvider{})
+	}
+	if r.MetaDataGCPLabels {
+		providers = append(providers, GCEMetaDataTagProvider{})
+	}
+	if r.MetaDataAzureTags {
+		providers = append(providers, AzureMetaDataTagProvider{})
+	}
+	if r.MetaDataK8s {
+		providers = append(providers, KubernetesMetaDataTagProvider{})
+	}
+
+	return providers
+}
+
+// cachedProviderTags queries the enabled cloud/orchestrator meta-data
+// providers at most once per process, no matter how many workers are
+// spawned from this pool, and returns the resulting "key=value" tags.
+func (r *AgentPool) cachedProviderTags() []string {
+	r.providerTagsOnce.Do(func() {
+		agent := &api.Agent{}
+		mergeProviderTags(agent, r.metadataTagProviders())
+		r.providerTags = agent.MetaData
+	})
+
+	return r.providerTags
+}
+
+// mergeProviderTags queries each provider in turn and appends its tags to
+// agent's meta-data, prefixing a tag's key with the provider's name if an
+// earlier provider already contributed the same key.
+func mergeProviderTags(agent *api.Agent, providers []MetadataTagProvider) {
+	existing := map[string]bool{}
+
+	for _, provider := range providers {
+		tags, err := provider.Get()
+		if err != nil {
+			// Don't blow up if we can't find them, just show a nasty error.
+			logger.Error(fmt.Sprintf("Failed to find %s meta-data: %s", provider.Name(), err.Error()))
+			continue
+		}
+
+		for tag, value := range tags {
+			key := tag
+			if existing[tag] {
+				key = fmt.Sprintf("%s-%s", provider.Name(), tag)
+			}
+			existing[key] = true
+
+			agent.MetaData = append(agent.MetaData, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+}
+
 // Takes the options passed to the CLI, and creates an api.Agent record that
 // will be sent to the Buildkite Agent API for registration.
-func (r *AgentPool) CreateAgentTemplate() *api.Agent {
+func (r *AgentPool) CreateAgentTemplate(name string) *api.Agent {
 	agent := &api.Agent{
-		Name:              r.Name,
+		Name:              name,
 		Priority:          r.Priority,
 		MetaData:          r.MetaData,
 		ScriptEvalEnabled: r.AgentConfiguration.CommandEval,
@@ -97,18 +337,10 @@ func (r *AgentPool) CreateAgentTemplate() *api.Agent {
 		PID:               os.Getpid(),
 	}
 
-	// Attempt to add the EC2 tags
-	if r.MetaDataEC2Tags {
-		tags, err := EC2Tags{}.Get()
-		if err != nil {
-			// Don't blow up if we can't find them, just show a nasty error.
-			logger.Error(fmt.Sprintf("Failed to find EC2 Tags: %s", err.Error()))
-		} else {
-			for tag, value := range tags {
-				agent.MetaData = append(agent.MetaData, fmt.Sprintf("%s=%s", tag, value))
-			}
-		}
-	}
+	// Attempt to add meta-data from any of the enabled cloud/orchestrator
+	// providers. This is cached across every worker CreateAgentTemplate
+	// spawns for, rather than queried fresh each time.
+	agent.MetaData = append(agent.MetaData, r.cachedProviderTags()...)
 
 	// Add the hostname
 	agent.Hostname, _ = os.Hostname()
@@ -189,4 +421,16 @@ func (r *AgentPool) ShowBanner() {
 	if !r.AgentConfiguration.RunInPty {
 		logger.Debug("Running builds within a pseudoterminal (PTY) has been disabled")
 	}
+
+	r.showResolvedConfig()
+}
+
+// showResolvedConfig prints every env-tagged field's resolved value,
+// including those on AgentConfiguration, redacting anything sensitive,
+// so it's obvious which flag, env var, or default produced the
+// configuration actually in use.
+func (r *AgentPool) showResolvedConfig() {
+	for _, pair := range ResolvedConfigPairs(r) {
+		logger.Debug("%s: %s", pair.Env, pair.Value)
+	}
 }
@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/signalwatcher"
+)
+
+// startFakeJobProcess starts a real, short-lived child process in its own
+// process group to stand in for a running job, so dispatchSignal's
+// process-group signalling can be exercised end-to-end. It traps USR1 and
+// USR2 rather than dying to them, the way a real bootstrap script or job
+// process might, so forwarding one of those can be told apart from
+// terminating it outright.
+func startFakeJobProcess(t *testing.T) *os.Process {
+	t.Helper()
+
+	cmd := exec.Command("sh", "-c", "trap '' USR1 USR2; sleep 5")
+	setNewProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start fake job process: %s", err)
+	}
+
+	return cmd.Process
+}
+
+// waitExited blocks until process exits or timeout elapses, returning
+// whether it exited in time.
+func waitExited(process *os.Process, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		process.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestDispatchSignalQuitStopsWorkerWithoutTouchingJob(t *testing.T) {
+	process := startFakeJobProcess(t)
+	defer process.Kill()
+
+	worker := &AgentWorker{jobProcess: process}
+	pool := &AgentPool{}
+
+	pool.dispatchSignal(worker, signalwatcher.QUIT)
+
+	if !worker.isStopping() {
+		t.Fatalf("expected QUIT to stop the worker")
+	}
+	if waitExited(process, 100*time.Millisecond) {
+		t.Fatalf("expected QUIT to leave the running job untouched")
+	}
+}
+
+func TestDispatchSignalIntCancelsJobAndStopsWorker(t *testing.T) {
+	process := startFakeJobProcess(t)
+
+	worker := &AgentWorker{jobProcess: process}
+	pool := &AgentPool{}
+
+	pool.dispatchSignal(worker, signalwatcher.INT)
+
+	if !worker.isStopping() {
+		t.Fatalf("expected INT to stop the worker")
+	}
+	if !waitExited(process, time.Second) {
+		process.Kill()
+		t.Fatalf("expected INT to cancel (terminate) the running job")
+	}
+}
+
+func TestDispatchSignalUsr1ForwardsToJobWithoutStopping(t *testing.T) {
+	process := startFakeJobProcess(t)
+	defer process.Kill()
+
+	worker := &AgentWorker{jobProcess: process}
+	pool := &AgentPool{}
+
+	pool.dispatchSignal(worker, signalwatcher.USR1)
+
+	if worker.isStopping() {
+		t.Fatalf("expected USR1 to leave the worker running")
+	}
+	if waitExited(process, 100*time.Millisecond) {
+		t.Fatalf("expected USR1 to be forwarded rather than kill the job")
+	}
+}
+
+func TestDispatchSignalUnrecognisedIsIgnored(t *testing.T) {
+	process := startFakeJobProcess(t)
+	defer process.Kill()
+
+	worker := &AgentWorker{jobProcess: process}
+	pool := &AgentPool{}
+
+	pool.dispatchSignal(worker, signalwatcher.Signal(-1))
+
+	if worker.isStopping() {
+		t.Fatalf("expected an unrecognised signal to be ignored")
+	}
+	if waitExited(process, 100*time.Millisecond) {
+		t.Fatalf("expected an unrecognised signal to leave the job untouched")
+	}
+}
+
+func TestCurrentJobProcessNilWhenIdle(t *testing.T) {
+	worker := &AgentWorker{}
+
+	if worker.CurrentJobProcess() != nil {
+		t.Fatalf("expected nil when no job is running")
+	}
+}
+
+// fakeMetaDataTagProvider is a MetadataTagProvider stand-in for tests, so
+// key-collision handling can be exercised without hitting a real
+// cloud/orchestrator meta-data endpoint.
+type fakeMetaDataTagProvider struct {
+	name string
+	tags map[string]string
+}
+
+func (p fakeMetaDataTagProvider) Name() string { return p.name }
+
+func (p fakeMetaDataTagProvider) Get() (map[string]string, error) {
+	return p.tags, nil
+}
+
+func TestMergeProviderTagsAddsTagsToTemplate(t *testing.T) {
+	pool := &AgentPool{AgentConfiguration: &AgentConfiguration{}}
+	agent := pool.CreateAgentTemplate("agent-1")
+
+	mergeProviderTags(agent, []MetadataTagProvider{
+		fakeMetaDataTagProvider{name: "ec2", tags: map[string]string{"region": "us-east-1"}},
+	})
+
+	if !containsMetaData(agent.MetaData, "region=us-east-1") {
+		t.Fatalf("expected region=us-east-1 in %v", agent.MetaData)
+	}
+}
+
+func TestMergeProviderTagsPrefixesCollidingKeys(t *testing.T) {
+	pool := &AgentPool{AgentConfiguration: &AgentConfiguration{}}
+	agent := pool.CreateAgentTemplate("agent-1")
+
+	mergeProviderTags(agent, []MetadataTagProvider{
+		fakeMetaDataTagProvider{name: "ec2", tags: map[string]string{"region": "us-east-1"}},
+		fakeMetaDataTagProvider{name: "gcp", tags: map[string]string{"region": "us-central1"}},
+	})
+
+	if !containsMetaData(agent.MetaData, "region=us-east-1") {
+		t.Fatalf("expected first provider's region to keep the bare key, got %v", agent.MetaData)
+	}
+	if !containsMetaData(agent.MetaData, "gcp-region=us-central1") {
+		t.Fatalf("expected second provider's region to be prefixed, got %v", agent.MetaData)
+	}
+}
+
+func containsMetaData(metaData []string, want string) bool {
+	for _, m := range metaData {
+		if m == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCachedProviderTagsQueriesProvidersOnlyOnce(t *testing.T) {
+	pool := &AgentPool{AgentConfiguration: &AgentConfiguration{}}
+
+	// Seed the cache as if a provider had already been queried once, the
+	// way the first CreateAgentTemplate call would. Because
+	// cachedProviderTags gates the real query behind the same
+	// sync.Once, a second caller - i.e. the next spawned worker - must
+	// see this seeded value rather than triggering another query.
+	pool.providerTagsOnce.Do(func() {
+		pool.providerTags = []string{"region=us-east-1"}
+	})
+
+	for i := 0; i < 3; i++ {
+		if got := pool.cachedProviderTags(); !containsMetaData(got, "region=us-east-1") {
+			t.Fatalf("expected cached provider tags to be reused, got %v", got)
+		}
+	}
+}
+
+func TestSpawnCountDefaultsToOne(t *testing.T) {
+	pool := &AgentPool{}
+
+	if got := pool.spawnCount(); got != 1 {
+		t.Fatalf("expected 1, got %d", got)
+	}
+}
+
+func TestSpawnCountUsesSpawn(t *testing.T) {
+	pool := &AgentPool{Spawn: 4}
+
+	if got := pool.spawnCount(); got != 4 {
+		t.Fatalf("expected 4, got %d", got)
+	}
+}
+
+func TestSpawnCountPerCPUOverridesSpawn(t *testing.T) {
+	pool := &AgentPool{Spawn: 4, SpawnPerCPU: true}
+
+	if got := pool.spawnCount(); got != runtime.NumCPU() {
+		t.Fatalf("expected %d, got %d", runtime.NumCPU(), got)
+	}
+}
+
+func TestAggregateExitStatusAllClean(t *testing.T) {
+	if got := aggregateExitStatus([]int{0, 0, 0}); got != 0 {
+		t.Fatalf("expected 0, got %d", got)
+	}
+}
+
+func TestAggregateExitStatusReturnsFirstFailure(t *testing.T) {
+	if got := aggregateExitStatus([]int{0, 2, 3}); got != 2 {
+		t.Fatalf("expected 2, got %d", got)
+	}
+}
+
+func TestAggregateExitStatusEmpty(t *testing.T) {
+	if got := aggregateExitStatus(nil); got != 0 {
+		t.Fatalf("expected 0, got %d", got)
+	}
+}
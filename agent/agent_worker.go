@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/buildkite/agent/signalwatcher"
+)
+
+// pingInterval is how often an idle worker polls Buildkite for its next
+// job.
+const pingInterval = 5 * time.Second
+
+// AgentWorker connects a single registered agent to Buildkite and runs
+// whatever jobs are assigned to it, one at a time, until stopped.
+type AgentWorker struct {
+	Agent              *api.Agent
+	AgentConfiguration *AgentConfiguration
+	Endpoint           string
+	APIClient          *api.Client
+	ExitStatus         int
+
+	stopMutex sync.Mutex
+	stopping  bool
+
+	jobMutex   sync.Mutex
+	jobProcess *os.Process
+}
+
+// Create finishes setting up the worker, building the API client it'll
+// use (with the access token handed back at registration) to talk to
+// Buildkite on the agent's behalf.
+//
+// This takes a pointer receiver (rather than copying AgentWorker by
+// value) because AgentWorker carries sync.Mutex fields, which must never
+// be copied once in use.
+func (w *AgentWorker) Create() *AgentWorker {
+	w.APIClient = APIClient{Endpoint: w.Endpoint, Token: w.Agent.AccessToken}.Create()
+	return w
+}
+
+// Connect lets Buildkite know that this agent is online and ready for
+// work.
+func (w *AgentWorker) Connect() error {
+	return retry.Do(func(s *retry.Stats) error {
+		_, err := w.APIClient.Agents.Connect()
+		if err != nil {
+			logger.Warn("%s (%s)", err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 1 * time.Second})
+}
+
+// Disconnect lets Buildkite know that this agent is going offline.
+func (w *AgentWorker) Disconnect() {
+	if _, err := w.APIClient.Agents.Disconnect(); err != nil {
+		logger.Warn("Failed to disconnect %s cleanly: %s", w.Agent.Name, err)
+	}
+}
+
+// Stop tells the worker to stop polling for new jobs once any job it's
+// currently running finishes.
+func (w *AgentWorker) Stop() {
+	w.stopMutex.Lock()
+	defer w.stopMutex.Unlock()
+	w.stopping = true
+}
+
+func (w *AgentWorker) isStopping() bool {
+	w.stopMutex.Lock()
+	defer w.stopMutex.Unlock()
+	return w.stopping
+}
+
+// Start polls Buildkite for jobs and runs them, one at a time, until the
+// worker is stopped.
+func (w *AgentWorker) Start() error {
+	for !w.isStopping() {
+		job, err := w.APIClient.Jobs.Next(w.Agent)
+		if err != nil {
+			logger.Warn("Failed to fetch next job for %s: %s", w.Agent.Name, err)
+			time.Sleep(pingInterval)
+			continue
+		}
+
+		if job == nil {
+			time.Sleep(pingInterval)
+			continue
+		}
+
+		if err := w.runJob(job); err != nil {
+			logger.Error("Job %s failed: %s", job.ID, err)
+			w.ExitStatus = 1
+		}
+	}
+
+	return nil
+}
+
+// runJob runs a job's bootstrap script as a child process of its own
+// process group, tracking it so CancelCurrentJob and ForwardSignal can
+// reach it while it's running.
+func (w *AgentWorker) runJob(job *api.Job) error {
+	cmd := exec.Command(w.AgentConfiguration.BootstrapScript)
+	setNewProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	w.setJobProcess(cmd.Process)
+	defer w.setJobProcess(nil)
+
+	return cmd.Wait()
+}
+
+func (w *AgentWorker) setJobProcess(process *os.Process) {
+	w.jobMutex.Lock()
+	defer w.jobMutex.Unlock()
+	w.jobProcess = process
+}
+
+// CurrentJobProcess returns the OS process of the job this worker is
+// currently running, or nil if it's idle.
+func (w *AgentWorker) CurrentJobProcess() *os.Process {
+	w.jobMutex.Lock()
+	defer w.jobMutex.Unlock()
+	return w.jobProcess
+}
+
+// CancelCurrentJob terminates the job currently running (if any), by
+// signalling its whole process group - equivalent to a user cancelling
+// the build from the dashboard.
+func (w *AgentWorker) CancelCurrentJob() {
+	process := w.CurrentJobProcess()
+	if process == nil {
+		return
+	}
+
+	logger.Info("Cancelling job, signalling process group %d", process.Pid)
+
+	if err := signalProcessGroup(process, signalwatcher.TERM); err != nil {
+		logger.Warn("Failed to cancel job: %s", err)
+	}
+}
+
+// ForwardSignal passes sig through to the process group of the job
+// currently running (if any), leaving the worker itself running -
+// similar to how an SSH server forwards a client-sent signal to the
+// remote command it's running.
+func (w *AgentWorker) ForwardSignal(sig signalwatcher.Signal) {
+	process := w.CurrentJobProcess()
+	if process == nil {
+		logger.Debug("No job running, nothing to forward signal `%s` to", sig.String())
+		return
+	}
+
+	logger.Info("Forwarding signal `%s` to job process group %d", sig.String(), process.Pid)
+
+	if err := signalProcessGroup(process, sig); err != nil {
+		logger.Warn("Failed to forward signal `%s`: %s", sig.String(), err)
+	}
+}
@@ -0,0 +1,25 @@
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/buildkite/agent/signalwatcher"
+)
+
+// setNewProcessGroup starts cmd in its own process group, so the whole
+// job tree (the bootstrap script and whatever it spawns) can be
+// signalled together rather than just the immediate child.
+func setNewProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup delivers sig to process's entire process group,
+// mirroring how an SSH server forwards a client-sent signal to the
+// remote command it's running.
+func signalProcessGroup(process *os.Process, sig signalwatcher.Signal) error {
+	return syscall.Kill(-process.Pid, syscall.Signal(sig))
+}
@@ -0,0 +1,23 @@
+// +build windows
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/buildkite/agent/signalwatcher"
+)
+
+// setNewProcessGroup is a no-op on Windows - there's no POSIX-style
+// process group to create.
+func setNewProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup has no signal-forwarding equivalent on Windows, so
+// the job's process is killed outright instead of being sent sig - for
+// cancellation and the pass-through signals alike. sig itself is never
+// delivered, and only the job's own process is killed, not any children
+// it has started.
+func signalProcessGroup(process *os.Process, sig signalwatcher.Signal) error {
+	return process.Kill()
+}
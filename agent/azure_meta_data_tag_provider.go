@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const azureMetaDataURL = "http://169.254.169.254/metadata/instance?api-version=2017-04-02"
+
+// AzureMetaDataTagProvider discovers tags from the Azure Instance Metadata
+// Service (IMDS). Azure tags are returned as a single semicolon-separated
+// `key1:value1;key2:value2` string, which is split out here.
+type AzureMetaDataTagProvider struct{}
+
+type azureMetaDataResponse struct {
+	Compute struct {
+		Tags string `json:"tags"`
+	} `json:"compute"`
+}
+
+func (p AzureMetaDataTagProvider) Name() string {
+	return "azure"
+}
+
+func (p AzureMetaDataTagProvider) Get() (map[string]string, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	req, err := http.NewRequest("GET", azureMetaDataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Azure meta-data server returned %d", resp.StatusCode)
+	}
+
+	var metadata azureMetaDataResponse
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for _, pair := range strings.Split(metadata.Compute.Tags, ";") {
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		tags[kv[0]] = kv[1]
+	}
+
+	return tags, nil
+}
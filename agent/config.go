@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// redactedEnvVars lists env-tagged fields whose resolved value should
+// never be printed verbatim, even in debug output.
+var redactedEnvVars = map[string]bool{
+	"BUILDKITE_AGENT_TOKEN":                 true,
+	"BUILDKITE_AGENT_EXTENSION_HMAC_SECRET": true,
+}
+
+// ConfigError is returned by ValidateRequiredConfig when one or more
+// fields were never set by a flag, environment variable, or config file.
+type ConfigError struct {
+	Missing []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("missing required configuration: %s", strings.Join(e.Missing, ", "))
+}
+
+// BindEnvironmentConfig fills any `env`-tagged field of config (a pointer
+// to a struct, e.g. *AgentPool) - and of any nested struct pointers
+// within it, such as AgentPool.AgentConfiguration - from the matching
+// BUILDKITE_AGENT_* environment variable.
+//
+// flagsSet records which env var names were already set explicitly by a
+// CLI flag (the caller populates it, typically from flag.Visit); those
+// are left untouched. That's what gives the agent's configuration its
+// precedence: CLI flag > env var > config file > default - a flag
+// explicitly set to its zero value (e.g. --priority="") still wins over
+// a conflicting environment variable. A nil flagsSet is treated as empty.
+func BindEnvironmentConfig(config interface{}, flagsSet map[string]bool) error {
+	return bindEnvironmentConfig(reflect.ValueOf(config).Elem(), flagsSet)
+}
+
+func bindEnvironmentConfig(v reflect.Value, flagsSet map[string]bool) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		fieldValue := v.Field(i)
+
+		if nested, ok := nestedConfigStruct(fieldValue); ok {
+			if err := bindEnvironmentConfig(nested, flagsSet); err != nil {
+				return err
+			}
+			continue
+		}
+
+		env := t.Field(i).Tag.Get("env")
+		if env == "" || flagsSet[env] {
+			continue
+		}
+
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		if err := setFieldFromString(fieldValue, value); err != nil {
+			return fmt.Errorf("%s: %s", env, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateRequiredConfig checks that every `env`-tagged field (including
+// those on nested struct pointers such as AgentPool.AgentConfiguration)
+// marked `required:"true"` has a non-zero value, returning a *ConfigError
+// listing everything that's missing.
+func ValidateRequiredConfig(config interface{}) error {
+	var missing []string
+	collectMissingRequired(reflect.ValueOf(config).Elem(), &missing)
+
+	if len(missing) > 0 {
+		return &ConfigError{Missing: missing}
+	}
+
+	return nil
+}
+
+func collectMissingRequired(v reflect.Value, missing *[]string) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		fieldValue := v.Field(i)
+
+		if nested, ok := nestedConfigStruct(fieldValue); ok {
+			collectMissingRequired(nested, missing)
+			continue
+		}
+
+		field := t.Field(i)
+		if field.Tag.Get("required") != "true" {
+			continue
+		}
+
+		if fieldValue.IsZero() {
+			*missing = append(*missing, field.Tag.Get("env"))
+		}
+	}
+}
+
+// ConfigPair is one resolved env-tagged field, as returned by
+// ResolvedConfigPairs.
+type ConfigPair struct {
+	Env   string
+	Value string
+}
+
+// ResolvedConfigPairs walks config - and any nested struct pointers
+// within it - collecting every env-tagged field's resolved value,
+// redacting anything sensitive. Used to show what's actually in effect
+// once every precedence layer has been applied.
+func ResolvedConfigPairs(config interface{}) []ConfigPair {
+	var pairs []ConfigPair
+	collectResolvedConfig(reflect.ValueOf(config).Elem(), &pairs)
+	return pairs
+}
+
+func collectResolvedConfig(v reflect.Value, pairs *[]ConfigPair) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		fieldValue := v.Field(i)
+
+		if nested, ok := nestedConfigStruct(fieldValue); ok {
+			collectResolvedConfig(nested, pairs)
+			continue
+		}
+
+		env := t.Field(i).Tag.Get("env")
+		if env == "" {
+			continue
+		}
+
+		value := fmt.Sprintf("%v", fieldValue.Interface())
+		*pairs = append(*pairs, ConfigPair{Env: env, Value: redactConfigValue(env, value)})
+	}
+}
+
+// nestedConfigStruct returns the dereferenced struct value behind a
+// non-nil pointer-to-struct field (such as AgentPool.AgentConfiguration),
+// so the config walkers above can recurse into it.
+func nestedConfigStruct(fieldValue reflect.Value) (reflect.Value, bool) {
+	if fieldValue.Kind() != reflect.Ptr || fieldValue.Type().Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+
+	if fieldValue.IsNil() {
+		return reflect.Value{}, false
+	}
+
+	return fieldValue.Elem(), true
+}
+
+// setFieldFromString assigns value (as read from the environment) to
+// field, converting it to match the field's underlying type.
+func setFieldFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type %s", field.Type())
+		}
+		field.Set(reflect.ValueOf(strings.Split(value, ",")))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Kind())
+	}
+
+	return nil
+}
+
+// redactConfigValue renders an env-tagged field's resolved value for
+// display, replacing anything in redactedEnvVars with asterisks.
+func redactConfigValue(env, value string) string {
+	if value != "" && redactedEnvVars[env] {
+		return "********"
+	}
+
+	return value
+}
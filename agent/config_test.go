@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"os"
+	"testing"
+)
+
+// withEnv sets key to value for the duration of the calling test, via
+// the returned restore func.
+func withEnv(t *testing.T, key, value string) func() {
+	t.Helper()
+
+	old, existed := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("failed to set %s: %s", key, err)
+	}
+
+	return func() {
+		if existed {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestBindEnvironmentConfigFillsFromEnv(t *testing.T) {
+	defer withEnv(t, "BUILDKITE_AGENT_NAME", "from-env")()
+
+	pool := &AgentPool{}
+	if err := BindEnvironmentConfig(pool, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if pool.Name != "from-env" {
+		t.Fatalf("expected Name to be set from env, got %q", pool.Name)
+	}
+}
+
+func TestBindEnvironmentConfigFlagTakesPrecedence(t *testing.T) {
+	defer withEnv(t, "BUILDKITE_AGENT_PRIORITY", "5")()
+
+	pool := &AgentPool{Priority: ""}
+	flagsSet := map[string]bool{"BUILDKITE_AGENT_PRIORITY": true}
+
+	if err := BindEnvironmentConfig(pool, flagsSet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if pool.Priority != "" {
+		t.Fatalf("expected flag-set zero value to win over env var, got %q", pool.Priority)
+	}
+}
+
+func TestBindEnvironmentConfigRecursesIntoAgentConfiguration(t *testing.T) {
+	defer withEnv(t, "BUILDKITE_AGENT_BUILD_PATH", "/tmp/builds")()
+
+	pool := &AgentPool{AgentConfiguration: &AgentConfiguration{}}
+	if err := BindEnvironmentConfig(pool, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if pool.AgentConfiguration.BuildPath != "/tmp/builds" {
+		t.Fatalf("expected nested BuildPath to be bound from env, got %q", pool.AgentConfiguration.BuildPath)
+	}
+}
+
+func TestValidateRequiredConfigReportsMissingToken(t *testing.T) {
+	pool := &AgentPool{}
+
+	err := ValidateRequiredConfig(pool)
+	if err == nil {
+		t.Fatalf("expected an error for a missing required Token")
+	}
+
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected a *ConfigError, got %T", err)
+	}
+	if len(configErr.Missing) != 1 || configErr.Missing[0] != "BUILDKITE_AGENT_TOKEN" {
+		t.Fatalf("expected BUILDKITE_AGENT_TOKEN to be reported missing, got %v", configErr.Missing)
+	}
+}
+
+func TestValidateRequiredConfigPassesWhenSet(t *testing.T) {
+	pool := &AgentPool{Token: "llamas"}
+
+	if err := ValidateRequiredConfig(pool); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestResolvedConfigPairsRedactsToken(t *testing.T) {
+	pool := &AgentPool{Token: "secret", AgentConfiguration: &AgentConfiguration{}}
+
+	for _, pair := range ResolvedConfigPairs(pool) {
+		if pair.Env == "BUILDKITE_AGENT_TOKEN" && pair.Value == "secret" {
+			t.Fatalf("expected token to be redacted in resolved config output")
+		}
+	}
+}
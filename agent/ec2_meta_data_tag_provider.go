@@ -0,0 +1,13 @@
+package agent
+
+// EC2MetaDataTagProvider discovers tags from the EC2 instance meta-data
+// service, via the existing EC2Tags helper.
+type EC2MetaDataTagProvider struct{}
+
+func (p EC2MetaDataTagProvider) Name() string {
+	return "ec2"
+}
+
+func (p EC2MetaDataTagProvider) Get() (map[string]string, error) {
+	return EC2Tags{}.Get()
+}
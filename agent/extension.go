@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/buildkite/agent/api"
+)
+
+// Extension is called with the agent's registration template before it's
+// sent to the Buildkite Agent API. This lets sites plug in entitlement
+// checks, cost-center tagging from an internal CMDB, or secret-vending
+// gates without patching the agent binary. Returning an error refuses the
+// registration entirely.
+type Extension interface {
+	Run(template *api.Agent) (*ExtensionResult, error)
+}
+
+// ExtensionResult is what an Extension can contribute to the agent
+// template: additional meta-data and/or a priority override.
+type ExtensionResult struct {
+	MetaData []string
+	Priority string
+}
+
+// HTTPExtension is an Extension backed by a remote HTTP endpoint. It
+// posts the template as JSON and expects an ExtensionResult back; a
+// non-2xx response refuses registration.
+type HTTPExtension struct {
+	URL        string
+	HMACSecret string
+}
+
+func (e HTTPExtension) Run(template *api.Agent) (*ExtensionResult, error) {
+	body, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if e.HMACSecret != "" {
+		req.Header.Set("X-Buildkite-Signature", e.sign(body))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("extension %s refused registration with status %d", e.URL, resp.StatusCode)
+	}
+
+	var result ExtensionResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// sign returns a hex-encoded HMAC-SHA256 signature of body, so the
+// extension server can verify the request genuinely came from this
+// agent and hasn't been tampered with in transit.
+func (e HTTPExtension) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(e.HMACSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
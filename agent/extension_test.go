@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+)
+
+// fakeExtension is an Extension stand-in for tests, so runExtensions's
+// merge/abort logic can be exercised without a real HTTPExtension.
+type fakeExtension struct {
+	result *ExtensionResult
+	err    error
+}
+
+func (e fakeExtension) Run(template *api.Agent) (*ExtensionResult, error) {
+	return e.result, e.err
+}
+
+func TestRunExtensionsAbortsOnARefusal(t *testing.T) {
+	pool := &AgentPool{Extensions: []Extension{
+		fakeExtension{err: fmt.Errorf("not entitled")},
+	}}
+
+	if err := pool.runExtensions(&api.Agent{}); err == nil {
+		t.Fatalf("expected a refusing extension to abort registration")
+	}
+}
+
+func TestRunExtensionsMergesMetaDataAndPriority(t *testing.T) {
+	pool := &AgentPool{Extensions: []Extension{
+		fakeExtension{result: &ExtensionResult{MetaData: []string{"cost-center=platform"}, Priority: "5"}},
+	}}
+
+	template := &api.Agent{Priority: "1"}
+	if err := pool.runExtensions(template); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !containsMetaData(template.MetaData, "cost-center=platform") {
+		t.Fatalf("expected extension meta-data to be merged, got %v", template.MetaData)
+	}
+	if template.Priority != "5" {
+		t.Fatalf("expected extension priority to override the template's, got %q", template.Priority)
+	}
+}
+
+func TestHTTPExtensionRunRefusesOnNon2xx(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	extension := HTTPExtension{URL: server.URL}
+	if _, err := extension.Run(&api.Agent{}); err == nil {
+		t.Fatalf("expected a non-2xx response to refuse registration")
+	}
+}
+
+func TestHTTPExtensionRunReturnsResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ExtensionResult{MetaData: []string{"region=us-east-1"}, Priority: "3"})
+	}))
+	defer server.Close()
+
+	extension := HTTPExtension{URL: server.URL}
+	result, err := extension.Run(&api.Agent{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !containsMetaData(result.MetaData, "region=us-east-1") {
+		t.Fatalf("expected region=us-east-1 in %v", result.MetaData)
+	}
+	if result.Priority != "3" {
+		t.Fatalf("expected priority 3, got %q", result.Priority)
+	}
+}
+
+func TestHTTPExtensionRunSetsSignatureHeaderWhenHMACSecretSet(t *testing.T) {
+	var gotSignature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get("X-Buildkite-Signature")
+		json.NewEncoder(w).Encode(ExtensionResult{})
+	}))
+	defer server.Close()
+
+	extension := HTTPExtension{URL: server.URL, HMACSecret: "s3cr3t"}
+	if _, err := extension.Run(&api.Agent{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if gotSignature == "" {
+		t.Fatalf("expected X-Buildkite-Signature to be set when HMACSecret is configured")
+	}
+}
+
+func TestHTTPExtensionRunOmitsSignatureHeaderWithoutHMACSecret(t *testing.T) {
+	var sawHeader bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, sawHeader = r.Header["X-Buildkite-Signature"]
+		json.NewEncoder(w).Encode(ExtensionResult{})
+	}))
+	defer server.Close()
+
+	extension := HTTPExtension{URL: server.URL}
+	if _, err := extension.Run(&api.Agent{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if sawHeader {
+		t.Fatalf("expected no X-Buildkite-Signature header without an HMACSecret")
+	}
+}
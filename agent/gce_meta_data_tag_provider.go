@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const gceMetaDataAttributesURL = "http://metadata.google.internal/computeMetadata/v1/instance/attributes/?recursive=true&alt=json"
+
+// GCEMetaDataTagProvider discovers tags from the custom instance attributes
+// exposed by the Google Compute Engine meta-data service. Instance labels
+// are not queried.
+type GCEMetaDataTagProvider struct{}
+
+func (p GCEMetaDataTagProvider) Name() string {
+	return "gcp"
+}
+
+func (p GCEMetaDataTagProvider) Get() (map[string]string, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	req, err := http.NewRequest("GET", gceMetaDataAttributesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GCE meta-data server returned %d", resp.StatusCode)
+	}
+
+	var attributes map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&attributes); err != nil {
+		return nil, err
+	}
+
+	return attributes, nil
+}
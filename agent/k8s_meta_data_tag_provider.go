@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// k8sPodInfoPath is the default mount point of a Kubernetes "downward API"
+// volume exposing pod labels/annotations as files.
+const k8sPodInfoPath = "/etc/podinfo"
+
+// k8sEnvVars are well-known downward-API environment variables, as set by
+// a `fieldRef`/`resourceFieldRef` in a pod spec.
+var k8sEnvVars = []string{"POD_NAME", "POD_NAMESPACE", "POD_IP", "NODE_NAME"}
+
+// KubernetesMetaDataTagProvider discovers tags from the Kubernetes
+// downward API, either via environment variables or files mounted from a
+// downward API volume (commonly at /etc/podinfo).
+type KubernetesMetaDataTagProvider struct{}
+
+func (p KubernetesMetaDataTagProvider) Name() string {
+	return "k8s"
+}
+
+func (p KubernetesMetaDataTagProvider) Get() (map[string]string, error) {
+	tags := map[string]string{}
+
+	for _, name := range k8sEnvVars {
+		if value := os.Getenv(name); value != "" {
+			tags[strings.ToLower(name)] = value
+		}
+	}
+
+	files, err := ioutil.ReadDir(k8sPodInfoPath)
+	if err != nil {
+		// No downward API volume mounted, that's fine - env vars (if any)
+		// are still useful on their own.
+		return tags, nil
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(k8sPodInfoPath, file.Name()))
+		if err != nil {
+			continue
+		}
+
+		tags[file.Name()] = strings.TrimSpace(string(contents))
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,16 @@
+package agent
+
+// MetadataTagProvider is implemented by anything that can discover tags
+// describing the environment the agent is running in, so they can be
+// attached to the agent on registration. EC2MetaDataTagProvider,
+// GCEMetaDataTagProvider, AzureMetaDataTagProvider and
+// KubernetesMetaDataTagProvider are the built-in implementations.
+type MetadataTagProvider interface {
+	// Name is a short, unique identifier for the provider. It's used to
+	// prefix meta-data keys when two providers return the same key.
+	Name() string
+
+	// Get returns the meta-data discovered by this provider as a map of
+	// tag name to value.
+	Get() (map[string]string, error)
+}